@@ -0,0 +1,100 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheFormatVersion viene incrementato ogni volta che cambia la struttura
+// della cache o la logica di scraping, cosi' le voci scritte da una versione
+// precedente dello scraper vengono ignorate invece di essere fidate alla cieca.
+const cacheFormatVersion = 1
+
+// chapterCache e' il contenuto, serializzato in JSON e poi compresso in gzip,
+// di un singolo file .taric-cache/<chapter>.json.gz.
+type chapterCache struct {
+	Version   int          `json:"version"`
+	ChapterID string       `json:"chapter_id"`
+	CachedAt  time.Time    `json:"cached_at"`
+	Entries   []TaricEntry `json:"entries"`
+}
+
+func chapterCachePath(cacheDir, chapterID string) string {
+	return filepath.Join(cacheDir, chapterID+".json.gz")
+}
+
+// loadChapterCache prova a leggere il risultato gia' calcolato per un capitolo.
+// Ritorna ok=false se il file non esiste, e' corrotto, appartiene a una
+// versione diversa dello scraper o e' piu' vecchio di maxAge.
+func loadChapterCache(cacheDir, chapterID string, maxAge time.Duration) (entries []TaricEntry, ok bool) {
+	f, err := os.Open(chapterCachePath(cacheDir, chapterID))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, false
+	}
+	defer gz.Close()
+
+	var cached chapterCache
+	if err := json.NewDecoder(gz).Decode(&cached); err != nil {
+		return nil, false
+	}
+
+	if cached.Version != cacheFormatVersion || cached.ChapterID != chapterID {
+		return nil, false
+	}
+
+	if maxAge > 0 && time.Since(cached.CachedAt) > maxAge {
+		return nil, false
+	}
+
+	return cached.Entries, true
+}
+
+// saveChapterCache scrive il risultato di un capitolo su disco in modo che un
+// run successivo possa saltarlo. Scrive prima su un file temporaneo e poi fa
+// una rename atomica, cosi' un crash a meta' scrittura non lascia una cache
+// corrotta al prossimo avvio.
+func saveChapterCache(cacheDir, chapterID string, entries []TaricEntry) error {
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return fmt.Errorf("impossibile creare la cache dir %s: %w", cacheDir, err)
+	}
+
+	tmp, err := os.CreateTemp(cacheDir, chapterID+".json.gz.tmp-*")
+	if err != nil {
+		return fmt.Errorf("impossibile creare il file temporaneo di cache per il capitolo %s: %w", chapterID, err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	gz := gzip.NewWriter(tmp)
+	enc := json.NewEncoder(gz)
+	cached := chapterCache{
+		Version:   cacheFormatVersion,
+		ChapterID: chapterID,
+		CachedAt:  time.Now(),
+		Entries:   entries,
+	}
+
+	if err := enc.Encode(cached); err != nil {
+		tmp.Close()
+		return fmt.Errorf("impossibile serializzare la cache per il capitolo %s: %w", chapterID, err)
+	}
+	if err := gz.Close(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("impossibile chiudere il writer gzip per il capitolo %s: %w", chapterID, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("impossibile chiudere il file temporaneo di cache per il capitolo %s: %w", chapterID, err)
+	}
+
+	return os.Rename(tmpPath, chapterCachePath(cacheDir, chapterID))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+)
+
+const (
+	addedDiffFile   = "added.csv"
+	removedDiffFile = "removed.csv"
+	changedDiffFile = "changed.csv"
+)
+
+// changedEntry descrive un codice presente sia nell'export precedente sia in
+// quello corrente, ma con una descrizione diversa.
+type changedEntry struct {
+	Code           string
+	OldDescription string
+	NewDescription string
+}
+
+// loadPreviousCSV legge un export prodotto da un run precedente (lo stesso
+// formato scritto da csvOutputWriter) in una mappa codice -> descrizione.
+func loadPreviousCSV(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("impossibile aprire il CSV precedente %s: %w", path, err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("impossibile leggere il CSV precedente %s: %w", path, err)
+	}
+
+	previous := make(map[string]string, len(records))
+	for _, record := range records {
+		if len(record) < 2 || record[0] == "Code" {
+			continue
+		}
+		previous[record[0]] = record[1]
+	}
+	return previous, nil
+}
+
+// writeDiff confronta current con l'export precedente in previousPath e
+// scrive added.csv, removed.csv e changed.csv nella directory corrente.
+func writeDiff(previousPath string, current []TaricEntry) error {
+	previous, err := loadPreviousCSV(previousPath)
+	if err != nil {
+		return err
+	}
+
+	currentByCode := make(map[string]string, len(current))
+	for _, entry := range current {
+		currentByCode[entry.Code] = entry.Description
+	}
+
+	var added []TaricEntry
+	var changed []changedEntry
+	for _, entry := range current {
+		oldDescription, existed := previous[entry.Code]
+		switch {
+		case !existed:
+			added = append(added, entry)
+		case oldDescription != entry.Description:
+			changed = append(changed, changedEntry{
+				Code:           entry.Code,
+				OldDescription: oldDescription,
+				NewDescription: entry.Description,
+			})
+		}
+	}
+
+	var removed []TaricEntry
+	for code, description := range previous {
+		if _, existed := currentByCode[code]; !existed {
+			removed = append(removed, TaricEntry{Code: code, Description: description})
+		}
+	}
+
+	sort.Slice(added, func(i, j int) bool { return added[i].Code < added[j].Code })
+	sort.Slice(removed, func(i, j int) bool { return removed[i].Code < removed[j].Code })
+	sort.Slice(changed, func(i, j int) bool { return changed[i].Code < changed[j].Code })
+
+	if err := writeEntriesCSV(addedDiffFile, added); err != nil {
+		return err
+	}
+	if err := writeEntriesCSV(removedDiffFile, removed); err != nil {
+		return err
+	}
+	if err := writeChangedCSV(changedDiffFile, changed); err != nil {
+		return err
+	}
+
+	fmt.Printf("Diff rispetto a %s: %d aggiunti, %d rimossi, %d modificati\n", previousPath, len(added), len(removed), len(changed))
+	return nil
+}
+
+func writeEntriesCSV(path string, entries []TaricEntry) error {
+	writer, err := newCSVOutputWriter(path)
+	if err != nil {
+		return err
+	}
+	if err := writer.WriteHeader(); err != nil {
+		writer.Close()
+		return fmt.Errorf("impossibile scrivere l'intestazione di %s: %w", path, err)
+	}
+	for _, entry := range entries {
+		if err := writer.Write(entry); err != nil {
+			writer.Close()
+			return fmt.Errorf("impossibile scrivere una riga di %s: %w", path, err)
+		}
+	}
+	return writer.Close()
+}
+
+func writeChangedCSV(path string, entries []changedEntry) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("impossibile creare %s: %w", path, err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	if err := writer.Write([]string{"Code", "Old Description", "New Description"}); err != nil {
+		return fmt.Errorf("impossibile scrivere l'intestazione di %s: %w", path, err)
+	}
+	for _, entry := range entries {
+		if err := writer.Write([]string{entry.Code, entry.OldDescription, entry.NewDescription}); err != nil {
+			return fmt.Errorf("impossibile scrivere una riga di %s: %w", path, err)
+		}
+	}
+	return nil
+}
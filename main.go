@@ -1,27 +1,36 @@
 package main
 
 import (
-	"encoding/csv"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const (
-	baseURL    = "https://www.trade-tariff.service.gov.uk/api/v2"
-	outputFile = "taric_codes_full.csv"
-	maxWorkers = 25
-	apiTimeout = 30 * time.Second
-	rateLimit  = 150 * time.Millisecond
-	maxRetries = 4
+	baseURL              = "https://www.trade-tariff.service.gov.uk/api/v2"
+	outputFile           = "taric_codes_full.csv"
+	maxWorkers           = 25
+	apiTimeout           = 30 * time.Second
+	maxRetries           = 4
+	defaultCacheDir      = ".taric-cache"
+	shutdownDrainTimeout = 10 * time.Second
+	defaultRPS           = 6.0
+	defaultBurst         = 1
+	defaultMinRPS        = 1.0
 )
 
 // Structs per il JSON (invariate)
@@ -47,45 +56,103 @@ type ChapterListResponse struct {
 }
 
 type TaricEntry struct {
-	Code        string
-	Description string
+	Code        string `json:"code"`
+	Description string `json:"description"`
 }
 
 var (
-	httpClient  = &http.Client{Timeout: apiTimeout}
-	rateLimiter = time.NewTicker(rateLimit)
+	httpClient = &http.Client{Timeout: apiTimeout}
+	logger     = slog.New(slog.NewJSONHandler(os.Stderr, nil))
 )
 
-func makeAPIRequest(url string) ([]byte, error) {
+// chapterIDContextKey porta l'ID del capitolo corrente nel context, cosi'
+// che makeAPIRequest possa includerlo nei log strutturati senza aggiungere
+// un parametro a tutta la catena di chiamate.
+type chapterIDContextKey struct{}
+
+func contextWithChapter(ctx context.Context, chapterID string) context.Context {
+	return context.WithValue(ctx, chapterIDContextKey{}, chapterID)
+}
+
+func chapterFromContext(ctx context.Context) string {
+	chapterID, _ := ctx.Value(chapterIDContextKey{}).(string)
+	return chapterID
+}
+
+// ctxSleep attende d, ma ritorna prima se ctx viene cancellato nel frattempo.
+func ctxSleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func makeAPIRequest(ctx context.Context, limiter *adaptiveLimiter, url string) ([]byte, error) {
 	var body []byte
 	var err error
+	chapter := chapterFromContext(ctx)
 
 	for i := 0; i < maxRetries; i++ {
-		<-rateLimiter.C
+		if waitErr := limiter.Wait(ctx); waitErr != nil {
+			return nil, waitErr
+		}
 
-		req, reqErr := http.NewRequest(http.MethodGet, url, nil)
+		req, reqErr := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 		if reqErr != nil {
 			return nil, fmt.Errorf("impossibile creare la richiesta per %s: %w", url, reqErr)
 		}
 		req.Header.Set("Accept", "application/vnd.uktt.v2")
 
+		start := time.Now()
+		inflightRequests.Inc()
 		res, doErr := httpClient.Do(req)
+		inflightRequests.Dec()
+		latencyMs := time.Since(start).Milliseconds()
+
 		if doErr != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			requestsTotal.WithLabelValues("error").Inc()
+			if i < maxRetries-1 {
+				retriesTotal.Inc()
+			}
+			logger.Warn("errore di rete", "url", url, "chapter", chapter, "attempt", i+1, "latency_ms", latencyMs, "error", doErr)
 			err = fmt.Errorf("errore di rete per %s: %w", url, doErr)
-			time.Sleep(time.Duration(1<<i) * time.Second)
+			if sleepErr := ctxSleep(ctx, time.Duration(1<<i)*time.Second); sleepErr != nil {
+				return nil, sleepErr
+			}
 			continue
 		}
 
 		if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
 			backoff := time.Duration(1<<i) * time.Second
-			log.Printf("Errore %d per %s. Attendo %v e riprovo...", res.StatusCode, url, backoff)
-			time.Sleep(backoff)
-			err = fmt.Errorf("risposta non valida dopo %d tentativi: status %d", i+1, res.StatusCode)
+			if res.StatusCode == http.StatusTooManyRequests {
+				limiter.OnThrottled()
+				if retryAfter, ok := retryAfterDuration(res); ok {
+					backoff = retryAfter
+				}
+			}
+			requestsTotal.WithLabelValues(strconv.Itoa(res.StatusCode)).Inc()
+			if i < maxRetries-1 {
+				retriesTotal.Inc()
+			}
+			logger.Warn("risposta non valida, riprovo", "url", url, "chapter", chapter, "attempt", i+1, "status", res.StatusCode, "latency_ms", latencyMs, "backoff", backoff.String())
 			res.Body.Close()
+			err = fmt.Errorf("risposta non valida dopo %d tentativi: status %d", i+1, res.StatusCode)
+			if sleepErr := ctxSleep(ctx, backoff); sleepErr != nil {
+				return nil, sleepErr
+			}
 			continue
 		}
 
 		if res.StatusCode != http.StatusOK {
+			requestsTotal.WithLabelValues(strconv.Itoa(res.StatusCode)).Inc()
+			logger.Error("risposta non valida", "url", url, "chapter", chapter, "attempt", i+1, "status", res.StatusCode, "latency_ms", latencyMs)
 			res.Body.Close()
 			return nil, fmt.Errorf("risposta non valida da %s: status %d", url, res.StatusCode)
 		}
@@ -95,12 +162,18 @@ func makeAPIRequest(url string) ([]byte, error) {
 		if err != nil {
 			return nil, fmt.Errorf("errore nella lettura della risposta: %w", err)
 		}
+		requestsTotal.WithLabelValues(strconv.Itoa(res.StatusCode)).Inc()
+		logger.Info("richiesta completata", "url", url, "chapter", chapter, "attempt", i+1, "status", res.StatusCode, "latency_ms", latencyMs)
+		limiter.OnSuccess()
 		return body, nil
 	}
 	return nil, err
 }
 
-func findDeclarableCommodities(commodityCode string, visited map[string]bool, finalEntries *[]TaricEntry) {
+func findDeclarableCommodities(ctx context.Context, limiter *adaptiveLimiter, commodityCode string, visited map[string]bool, finalEntries *[]TaricEntry) {
+	if ctx.Err() != nil {
+		return
+	}
 	if visited[commodityCode] {
 		return
 	}
@@ -112,14 +185,14 @@ func findDeclarableCommodities(commodityCode string, visited map[string]bool, fi
 	}
 
 	url := fmt.Sprintf("%s/%s/%s", baseURL, endpointType, commodityCode)
-	body, err := makeAPIRequest(url)
+	body, err := makeAPIRequest(ctx, limiter, url)
 	if err != nil {
 		return
 	}
 
 	var response APIResponse
 	if err := json.Unmarshal(body, &response); err != nil {
-		log.Printf("Errore parsing JSON per il codice %s: %v\n", commodityCode, err)
+		logger.Error("errore nel parsing del JSON", "chapter", chapterFromContext(ctx), "code", commodityCode, "error", err)
 		return
 	}
 
@@ -133,17 +206,21 @@ func findDeclarableCommodities(commodityCode string, visited map[string]bool, fi
 	if len(response.Included) > 0 {
 		for _, child := range response.Included {
 			if child.Type == "commodity" || child.Type == "heading" {
-				findDeclarableCommodities(child.Attributes.GoodsNomenclatureItemID, visited, finalEntries)
+				findDeclarableCommodities(ctx, limiter, child.Attributes.GoodsNomenclatureItemID, visited, finalEntries)
 			}
 		}
 	}
 }
 
 // La funzione worker ora non stampa più nulla
-func processChapter(chapterID string) []TaricEntry {
+func processChapter(ctx context.Context, limiter *adaptiveLimiter, chapterID string) []TaricEntry {
+	start := time.Now()
+	defer func() { chapterDuration.Observe(time.Since(start).Seconds()) }()
+
+	ctx = contextWithChapter(ctx, chapterID)
 	var finalEntries []TaricEntry
 	visited := make(map[string]bool)
-	findDeclarableCommodities(chapterID, visited, &finalEntries)
+	findDeclarableCommodities(ctx, limiter, chapterID, visited, &finalEntries)
 	return finalEntries
 }
 
@@ -158,10 +235,42 @@ func printProgressBar(completed, total int) {
 }
 
 func main() {
-	defer rateLimiter.Stop()
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		runServe(os.Args[2:])
+		return
+	}
+
+	cacheDir := flag.String("cache-dir", defaultCacheDir, "Directory dove salvare/leggere la cache per-capitolo")
+	refresh := flag.Bool("refresh", false, "Ignora la cache esistente e riscarica tutti i capitoli")
+	maxAge := flag.Duration("max-age", 0, "Considera la cache scaduta se piu' vecchia di questo intervallo (0 = mai)")
+	output := flag.String("output", outputFile, "Percorso del file (o database) di output")
+	outputFormat := flag.String("output-format", "csv", "Formato di output: csv, json, jsonl o sqlite")
+	rps := flag.Float64("rps", defaultRPS, "Richieste al secondo massime (tetto verso cui si recupera dopo un rallentamento)")
+	burst := flag.Int("burst", defaultBurst, "Numero di richieste in burst concesse dal rate limiter")
+	minRPS := flag.Float64("min-rps", defaultMinRPS, "Richieste al secondo minime sotto cui il rate limiter non scende mai")
+	diff := flag.String("diff", "", "Percorso di un precedente taric_codes_full.csv da confrontare con i risultati di questo run")
+	metricsAddr := flag.String("metrics-addr", "", "Indirizzo su cui esporre le metriche Prometheus (es. :9090); vuoto per disabilitarle")
+	flag.Parse()
+
+	startMetricsServer(*metricsAddr)
+
+	limiter := newAdaptiveLimiter(*rps, *burst, *minRPS)
+
+	// allFoundEntries e' protetta da mu perche' viene letta sia dalla
+	// goroutine di raccolta risultati sia, in caso di interruzione, dal
+	// codice di spegnimento che deve salvare il lavoro fatto fin qui.
+	var mu sync.Mutex
+	var allFoundEntries []TaricEntry
+
+	// ctx viene cancellato alla ricezione di SIGINT/SIGTERM: questo si
+	// propaga a makeAPIRequest, findDeclarableCommodities e al pool di
+	// worker, che smettono di accettare nuovo lavoro e interrompono le
+	// richieste in corso invece di continuare fino alla fine naturale.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	fmt.Println("Recupero la lista dei capitoli...")
-	chapterListBody, err := makeAPIRequest(baseURL + "/chapters")
+	chapterListBody, err := makeAPIRequest(ctx, limiter, baseURL+"/chapters")
 	if err != nil {
 		log.Fatalf("Errore critico, impossibile recuperare i capitoli: %v", err)
 	}
@@ -178,6 +287,7 @@ func main() {
 
 	totalChapters := len(chapterIDs)
 	var completedChapters int32 = 0
+	chaptersRemaining.Set(float64(totalChapters))
 
 	jobs := make(chan string, totalChapters)
 	resultsChan := make(chan []TaricEntry, totalChapters)
@@ -204,40 +314,79 @@ func main() {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for chapterID := range jobs {
-				// Il worker processa il capitolo...
-				result := processChapter(chapterID)
-				// ...invia il risultato...
-				resultsChan <- result
-				// ...e infine incrementa il contatore.
-				atomic.AddInt32(&completedChapters, 1)
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case chapterID, ok := <-jobs:
+					if !ok {
+						return
+					}
+					var result []TaricEntry
+					if cached, ok := loadChapterCache(*cacheDir, chapterID, *maxAge); ok && !*refresh {
+						result = cached
+					} else {
+						// Il worker processa il capitolo...
+						result = processChapter(ctx, limiter, chapterID)
+						if ctx.Err() == nil {
+							if err := saveChapterCache(*cacheDir, chapterID, result); err != nil {
+								log.Printf("Attenzione: impossibile salvare la cache per il capitolo %s: %v", chapterID, err)
+							}
+						}
+					}
+					// ...invia il risultato...
+					resultsChan <- result
+					// ...e infine incrementa il contatore.
+					atomic.AddInt32(&completedChapters, 1)
+					chaptersRemaining.Dec()
+				}
 			}
 		}()
 	}
 
 	fmt.Printf("Avvio del processo di analisi con %d workers...\n", maxWorkers)
 
+feed:
 	for _, id := range chapterIDs {
-		jobs <- id
+		select {
+		case jobs <- id:
+		case <-ctx.Done():
+			break feed
+		}
 	}
 	close(jobs)
 
 	// Goroutine per attendere che i risultati vengano raccolti
 	var collectWg sync.WaitGroup
 	collectWg.Add(1)
-	var allFoundEntries []TaricEntry
 	go func() {
 		defer collectWg.Done()
 		for entries := range resultsChan {
 			if entries != nil {
+				mu.Lock()
 				allFoundEntries = append(allFoundEntries, entries...)
+				mu.Unlock()
 			}
 		}
 	}()
 
-	wg.Wait()
-	close(resultsChan)
-	collectWg.Wait()
+	// Se lo spegnimento e' in corso, non si aspetta indefinitamente: i
+	// worker hanno un tempo limitato per terminare le richieste in corso
+	// prima che si proceda comunque a salvare quanto raccolto finora.
+	drained := true
+	if ctx.Err() != nil {
+		drained = waitTimeout(&wg, shutdownDrainTimeout)
+		if !drained {
+			log.Printf("Timeout di spegnimento superato: alcuni worker non hanno terminato, salvo i risultati raccolti finora")
+		}
+	} else {
+		wg.Wait()
+	}
+
+	if drained {
+		close(resultsChan)
+		collectWg.Wait()
+	}
 
 	// Ferma la goroutine della barra del progresso
 	done <- true
@@ -246,9 +395,53 @@ func main() {
 	printProgressBar(totalChapters, totalChapters)
 	fmt.Println("\nProcesso di download completato. Scrittura del file...")
 
+	mu.Lock()
+	entries := append([]TaricEntry(nil), allFoundEntries...)
+	mu.Unlock()
+
+	uniqueEntries, err := writeResults(entries, *output, *outputFormat)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	fmt.Printf("Operazione completata. Trovati %d codici unici.\n", len(uniqueEntries))
+	fmt.Printf("I risultati sono stati salvati in: %s (formato %s)\n", *output, *outputFormat)
+
+	if *diff != "" {
+		if err := writeDiff(*diff, uniqueEntries); err != nil {
+			log.Printf("Attenzione: impossibile calcolare il diff rispetto a %s: %v", *diff, err)
+		}
+	}
+
+	if ctx.Err() != nil {
+		os.Exit(1)
+	}
+}
+
+// waitTimeout attende che wg si svuoti, ma ritorna false se non ci riesce
+// entro timeout invece di bloccare indefinitamente.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// writeResults deduplica le entries per codice, le ordina e le scrive in path
+// usando l'OutputWriter per il formato richiesto. Viene chiamata una sola
+// volta al termine di main, sia dopo uno scraping completo sia dopo
+// un'interruzione via SIGINT/SIGTERM, nel qual caso salva i risultati parziali.
+func writeResults(entries []TaricEntry, path, format string) ([]TaricEntry, error) {
 	seen := make(map[string]bool)
 	var uniqueEntries []TaricEntry
-	for _, entry := range allFoundEntries {
+	for _, entry := range entries {
 		if !seen[entry.Code] {
 			seen[entry.Code] = true
 			uniqueEntries = append(uniqueEntries, entry)
@@ -259,25 +452,25 @@ func main() {
 		return uniqueEntries[i].Code < uniqueEntries[j].Code
 	})
 
-	file, err := os.Create(outputFile)
+	writer, err := newOutputWriter(format, path)
 	if err != nil {
-		log.Fatalf("Impossibile creare il file di output: %v", err)
+		return nil, err
 	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
 
-	if err = writer.Write([]string{"Code", "Description"}); err != nil {
-		log.Fatalf("Impossibile scrivere l'intestazione del CSV: %v", err)
+	if err := writer.WriteHeader(); err != nil {
+		writer.Close()
+		return nil, fmt.Errorf("impossibile scrivere l'intestazione dell'output: %w", err)
 	}
 
 	for _, entry := range uniqueEntries {
-		if err = writer.Write([]string{entry.Code, entry.Description}); err != nil {
+		if err := writer.Write(entry); err != nil {
 			log.Printf("Attenzione: impossibile scrivere la riga per il codice %s: %v", entry.Code, err)
 		}
 	}
 
-	fmt.Printf("Operazione completata. Trovati %d codici unici.\n", len(uniqueEntries))
-	fmt.Printf("I risultati sono stati salvati nel file: %s\n", outputFile)
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("impossibile chiudere l'output: %w", err)
+	}
+
+	return uniqueEntries, nil
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "taric_requests_total",
+		Help: "Numero totale di richieste HTTP verso l'API trade-tariff, per status.",
+	}, []string{"status"})
+
+	retriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "taric_retries_total",
+		Help: "Numero totale di retry effettuati verso l'API trade-tariff.",
+	})
+
+	chapterDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "taric_chapter_duration_seconds",
+		Help:    "Durata dell'analisi di un capitolo, dalla richiesta iniziale all'ultimo nodo visitato.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	inflightRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "taric_inflight_requests",
+		Help: "Numero di richieste HTTP attualmente in corso verso l'API trade-tariff.",
+	})
+
+	chaptersRemaining = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "taric_chapters_remaining",
+		Help: "Numero di capitoli ancora da analizzare nel run corrente.",
+	})
+)
+
+// startMetricsServer avvia, se addr non e' vuoto, un server HTTP separato
+// che espone le metriche Prometheus su /metrics.
+func startMetricsServer(addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Error("server delle metriche terminato con un errore", "addr", addr, "error", err)
+		}
+	}()
+}
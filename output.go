@@ -0,0 +1,189 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	_ "modernc.org/sqlite"
+)
+
+// OutputWriter astrae la scrittura delle entries verso un formato di output.
+// Le implementazioni vengono scelte in base al flag --output-format.
+type OutputWriter interface {
+	WriteHeader() error
+	Write(entry TaricEntry) error
+	Close() error
+}
+
+// newOutputWriter crea l'OutputWriter per il formato richiesto, aprendo (o
+// creando) il file o il database in path.
+func newOutputWriter(format, path string) (OutputWriter, error) {
+	switch format {
+	case "", "csv":
+		return newCSVOutputWriter(path)
+	case "json":
+		return newJSONOutputWriter(path)
+	case "jsonl":
+		return newJSONLOutputWriter(path)
+	case "sqlite":
+		return newSQLiteOutputWriter(path)
+	default:
+		return nil, fmt.Errorf("formato di output sconosciuto: %s", format)
+	}
+}
+
+// --- CSV (comportamento storico) ---
+
+type csvOutputWriter struct {
+	file   *os.File
+	writer *csv.Writer
+}
+
+func newCSVOutputWriter(path string) (*csvOutputWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("impossibile creare il file di output: %w", err)
+	}
+	return &csvOutputWriter{file: file, writer: csv.NewWriter(file)}, nil
+}
+
+func (w *csvOutputWriter) WriteHeader() error {
+	return w.writer.Write([]string{"Code", "Description"})
+}
+
+func (w *csvOutputWriter) Write(entry TaricEntry) error {
+	return w.writer.Write([]string{entry.Code, entry.Description})
+}
+
+func (w *csvOutputWriter) Close() error {
+	w.writer.Flush()
+	if err := w.writer.Error(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// --- JSON (array) ---
+
+type jsonOutputWriter struct {
+	file  *os.File
+	enc   *json.Encoder
+	first bool
+}
+
+func newJSONOutputWriter(path string) (*jsonOutputWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("impossibile creare il file di output: %w", err)
+	}
+	return &jsonOutputWriter{file: file, enc: json.NewEncoder(file), first: true}, nil
+}
+
+func (w *jsonOutputWriter) WriteHeader() error {
+	_, err := w.file.WriteString("[\n")
+	return err
+}
+
+func (w *jsonOutputWriter) Write(entry TaricEntry) error {
+	if !w.first {
+		if _, err := w.file.WriteString(","); err != nil {
+			return err
+		}
+	}
+	w.first = false
+	return w.enc.Encode(entry)
+}
+
+func (w *jsonOutputWriter) Close() error {
+	if _, err := w.file.WriteString("]\n"); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// --- JSONL (newline-delimited JSON) ---
+
+type jsonlOutputWriter struct {
+	file *os.File
+	enc  *json.Encoder
+}
+
+func newJSONLOutputWriter(path string) (*jsonlOutputWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("impossibile creare il file di output: %w", err)
+	}
+	return &jsonlOutputWriter{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (w *jsonlOutputWriter) WriteHeader() error { return nil }
+
+func (w *jsonlOutputWriter) Write(entry TaricEntry) error {
+	return w.enc.Encode(entry)
+}
+
+func (w *jsonlOutputWriter) Close() error {
+	return w.file.Close()
+}
+
+// --- SQLite ---
+
+type sqliteOutputWriter struct {
+	db   *sql.DB
+	tx   *sql.Tx
+	stmt *sql.Stmt
+}
+
+func newSQLiteOutputWriter(path string) (*sqliteOutputWriter, error) {
+	os.Remove(path)
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("impossibile aprire il database sqlite %s: %w", path, err)
+	}
+
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS codes (code TEXT PRIMARY KEY, description TEXT)`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("impossibile creare la tabella codes: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("impossibile aprire la transazione sqlite: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO codes (code, description) VALUES (?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		db.Close()
+		return nil, fmt.Errorf("impossibile preparare la insert sqlite: %w", err)
+	}
+
+	return &sqliteOutputWriter{db: db, tx: tx, stmt: stmt}, nil
+}
+
+func (w *sqliteOutputWriter) WriteHeader() error { return nil }
+
+func (w *sqliteOutputWriter) Write(entry TaricEntry) error {
+	_, err := w.stmt.Exec(entry.Code, entry.Description)
+	return err
+}
+
+func (w *sqliteOutputWriter) Close() error {
+	if err := w.stmt.Close(); err != nil {
+		w.tx.Rollback()
+		w.db.Close()
+		return err
+	}
+	if err := w.tx.Commit(); err != nil {
+		w.db.Close()
+		return err
+	}
+	return w.db.Close()
+}
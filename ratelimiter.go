@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// rateLimitWindow e' la finestra scorrevole su cui si contano i 429
+	// ricevuti per decidere se dimezzare la velocita'.
+	rateLimitWindow = time.Minute
+	// failureThreshold e' il numero di 429 nella finestra che fa scattare
+	// il dimezzamento della velocita'.
+	failureThreshold = 3
+	// successStreakToRestore e' il numero di richieste consecutive andate
+	// a buon fine dopo cui si prova a recuperare verso il tetto configurato.
+	successStreakToRestore = 50
+	// restoreFactor e' il fattore di crescita applicato ogni volta che lo
+	// streak di successi viene raggiunto.
+	restoreFactor = 1.2
+)
+
+// adaptiveLimiter avvolge un rate.Limiter condiviso fra tutti i worker,
+// riducendone la velocita' quando l'API risponde 429 a raffica e
+// recuperandola gradualmente quando le richieste tornano ad andare a buon
+// fine, senza mai scendere sotto minRPS ne' superare ceilingRPS.
+type adaptiveLimiter struct {
+	limiter *rate.Limiter
+
+	mu             sync.Mutex
+	ceilingRPS     rate.Limit
+	minRPS         rate.Limit
+	recentFailures []time.Time
+	successStreak  int
+}
+
+func newAdaptiveLimiter(rps float64, burst int, minRPS float64) *adaptiveLimiter {
+	ceiling := rate.Limit(rps)
+	return &adaptiveLimiter{
+		limiter:    rate.NewLimiter(ceiling, burst),
+		ceilingRPS: ceiling,
+		minRPS:     rate.Limit(minRPS),
+	}
+}
+
+// Wait blocca finche' non viene concesso un nuovo permesso, o ritorna prima
+// se ctx viene cancellato.
+func (a *adaptiveLimiter) Wait(ctx context.Context) error {
+	return a.limiter.Wait(ctx)
+}
+
+// OnSuccess segnala una richiesta andata a buon fine. Dopo una serie
+// sufficientemente lunga di successi consecutivi, la velocita' viene
+// aumentata gradualmente verso ceilingRPS.
+func (a *adaptiveLimiter) OnSuccess() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.successStreak++
+	if a.successStreak < successStreakToRestore {
+		return
+	}
+	a.successStreak = 0
+
+	current := a.limiter.Limit()
+	if current >= a.ceilingRPS {
+		return
+	}
+	next := current * restoreFactor
+	if next > a.ceilingRPS {
+		next = a.ceilingRPS
+	}
+	a.limiter.SetLimit(next)
+}
+
+// OnThrottled segnala un 429 ricevuto dall'API. Se se ne accumulano almeno
+// failureThreshold entro rateLimitWindow, la velocita' viene dimezzata (mai
+// sotto minRPS).
+func (a *adaptiveLimiter) OnThrottled() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.successStreak = 0
+
+	now := time.Now()
+	cutoff := now.Add(-rateLimitWindow)
+	fresh := a.recentFailures[:0]
+	for _, t := range a.recentFailures {
+		if t.After(cutoff) {
+			fresh = append(fresh, t)
+		}
+	}
+	a.recentFailures = append(fresh, now)
+
+	if len(a.recentFailures) < failureThreshold {
+		return
+	}
+	a.recentFailures = nil
+
+	current := a.limiter.Limit()
+	next := current / 2
+	if next < a.minRPS {
+		next = a.minRPS
+	}
+	a.limiter.SetLimit(next)
+}
+
+// retryAfterDuration interpreta l'header Retry-After (in secondi o come data
+// HTTP) e ritorna l'attesa richiesta dal server, se presente e valida.
+func retryAfterDuration(res *http.Response) (time.Duration, bool) {
+	value := res.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if when, err := http.ParseTime(value); err == nil {
+		if d := time.Until(when); d > 0 {
+			return d, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxPageSize e' il limite massimo accettato per il parametro page_size di
+// GET /codes, per evitare overflow nel calcolo degli indici di pagina e
+// risposte da migliaia di voci.
+const maxPageSize = 1000
+
+// chapterState descrive lo stato di avanzamento di un singolo capitolo
+// esposto da GET /chapters/{id}/status.
+type chapterState struct {
+	State      string    `json:"state"` // pending, running, done, error
+	UpdatedAt  time.Time `json:"updated_at"`
+	EntryCount int       `json:"entry_count"`
+}
+
+// scrapeServer mantiene in memoria l'ultimo risultato noto dello scraping e
+// lo espone via HTTP. Tutto lo stato condiviso e' protetto da mu, cosi' le
+// richieste HTTP possono essere servite mentre un refresh e' in corso.
+type scrapeServer struct {
+	cacheDir string
+	refresh  bool
+	maxAge   time.Duration
+	limiter  *adaptiveLimiter
+
+	mu         sync.RWMutex
+	chapterIDs []string
+	chapters   map[string]*chapterState
+	entries    map[string]TaricEntry
+
+	events *eventBroker
+}
+
+func newScrapeServer(cacheDir string, refresh bool, maxAge time.Duration, limiter *adaptiveLimiter) *scrapeServer {
+	return &scrapeServer{
+		cacheDir: cacheDir,
+		refresh:  refresh,
+		maxAge:   maxAge,
+		limiter:  limiter,
+		chapters: make(map[string]*chapterState),
+		entries:  make(map[string]TaricEntry),
+		events:   newEventBroker(),
+	}
+}
+
+// scrapeChapters scarica (o legge dalla cache) i capitoli indicati e
+// aggiorna lo stato condiviso, pubblicando un evento SSE ogni volta che un
+// capitolo passa a running, done o error (il passaggio iniziale a pending
+// non genera eventi).
+func (s *scrapeServer) scrapeChapters(ctx context.Context, chapterIDs []string) {
+	s.mu.Lock()
+	for _, id := range chapterIDs {
+		if _, known := s.chapters[id]; !known {
+			s.chapterIDs = append(s.chapterIDs, id)
+		}
+		s.chapters[id] = &chapterState{State: "pending", UpdatedAt: time.Now()}
+	}
+	s.mu.Unlock()
+
+	chaptersRemaining.Set(float64(len(chapterIDs)))
+
+	jobs := make(chan string, len(chapterIDs))
+	for _, id := range chapterIDs {
+		jobs <- id
+	}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	for i := 0; i < maxWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chapterID := range jobs {
+				s.setChapterState(chapterID, "running", 0)
+
+				var result []TaricEntry
+				if cached, ok := loadChapterCache(s.cacheDir, chapterID, s.maxAge); ok && !s.refresh {
+					result = cached
+				} else {
+					result = processChapter(ctx, s.limiter, chapterID)
+					if ctx.Err() == nil {
+						if err := saveChapterCache(s.cacheDir, chapterID, result); err != nil {
+							log.Printf("Attenzione: impossibile salvare la cache per il capitolo %s: %v", chapterID, err)
+						}
+					}
+				}
+
+				if ctx.Err() != nil {
+					s.setChapterState(chapterID, "error", len(result))
+					chaptersRemaining.Dec()
+					continue
+				}
+
+				s.mu.Lock()
+				for _, entry := range result {
+					s.entries[entry.Code] = entry
+				}
+				s.mu.Unlock()
+
+				s.setChapterState(chapterID, "done", len(result))
+				chaptersRemaining.Dec()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *scrapeServer) setChapterState(chapterID, state string, entryCount int) {
+	s.mu.Lock()
+	s.chapters[chapterID] = &chapterState{State: state, UpdatedAt: time.Now(), EntryCount: entryCount}
+	s.mu.Unlock()
+
+	s.events.publish(fmt.Sprintf(`{"chapter":%q,"state":%q,"entry_count":%d}`, chapterID, state, entryCount))
+}
+
+func (s *scrapeServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /codes", s.handleListCodes)
+	mux.HandleFunc("GET /codes/{code}", s.handleGetCode)
+	mux.HandleFunc("GET /chapters/{id}/status", s.handleChapterStatus)
+	mux.HandleFunc("POST /refresh", s.handlePostRefresh)
+	mux.HandleFunc("GET /events", s.handleEvents)
+	return mux
+}
+
+func (s *scrapeServer) handleListCodes(w http.ResponseWriter, r *http.Request) {
+	page, pageSize := 1, 100
+	if v := r.URL.Query().Get("page"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			page = n
+		}
+	}
+	if v := r.URL.Query().Get("page_size"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= maxPageSize {
+			pageSize = n
+		}
+	}
+
+	s.mu.RLock()
+	all := make([]TaricEntry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		all = append(all, entry)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(all, func(i, j int) bool { return all[i].Code < all[j].Code })
+
+	start := (page - 1) * pageSize
+	if start < 0 || start > len(all) {
+		start = len(all)
+	}
+	end := start + pageSize
+	if end < start || end > len(all) {
+		end = len(all)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"page":      page,
+		"page_size": pageSize,
+		"total":     len(all),
+		"codes":     all[start:end],
+	})
+}
+
+func (s *scrapeServer) handleGetCode(w http.ResponseWriter, r *http.Request) {
+	code := r.PathValue("code")
+
+	s.mu.RLock()
+	entry, ok := s.entries[code]
+	s.mu.RUnlock()
+
+	if !ok {
+		http.Error(w, "codice non trovato", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, entry)
+}
+
+func (s *scrapeServer) handleChapterStatus(w http.ResponseWriter, r *http.Request) {
+	chapterID := r.PathValue("id")
+
+	s.mu.RLock()
+	state, ok := s.chapters[chapterID]
+	s.mu.RUnlock()
+
+	if !ok {
+		http.Error(w, "capitolo sconosciuto", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+type refreshRequest struct {
+	Chapters []string `json:"chapters"`
+}
+
+func (s *scrapeServer) handlePostRefresh(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("body non valido: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	chapterIDs := req.Chapters
+	if len(chapterIDs) == 0 {
+		s.mu.RLock()
+		chapterIDs = append([]string(nil), s.chapterIDs...)
+		s.mu.RUnlock()
+	}
+
+	go s.scrapeChapters(context.Background(), chapterIDs)
+
+	writeJSON(w, http.StatusAccepted, map[string]any{"chapters": chapterIDs})
+}
+
+func (s *scrapeServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming non supportato", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-ch:
+			fmt.Fprintf(w, "data: %s\n\n", event)
+			flusher.Flush()
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Attenzione: impossibile scrivere la risposta JSON: %v", err)
+	}
+}
+
+// eventBroker inoltra gli eventi di progresso a tutti i client SSE connessi.
+type eventBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan string]bool
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subscribers: make(map[chan string]bool)}
+}
+
+func (b *eventBroker) subscribe() chan string {
+	ch := make(chan string, 16)
+	b.mu.Lock()
+	b.subscribers[ch] = true
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan string) {
+	b.mu.Lock()
+	delete(b.subscribers, ch)
+	b.mu.Unlock()
+}
+
+func (b *eventBroker) publish(event string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Il client e' troppo lento a consumare: si salta l'evento
+			// piuttosto che bloccare lo scraping.
+		}
+	}
+}
+
+// runServe implementa il sottocomando `serve`: mantiene lo scraper in
+// esecuzione e ne espone progresso e risultati via HTTP invece di scrivere
+// un CSV e terminare.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", ":8080", "Indirizzo di ascolto del server HTTP")
+	cacheDir := fs.String("cache-dir", defaultCacheDir, "Directory dove salvare/leggere la cache per-capitolo")
+	refresh := fs.Bool("refresh", false, "Ignora la cache esistente e riscarica tutti i capitoli")
+	maxAge := fs.Duration("max-age", 0, "Considera la cache scaduta se piu' vecchia di questo intervallo (0 = mai)")
+	rps := fs.Float64("rps", defaultRPS, "Richieste al secondo massime verso l'API")
+	burst := fs.Int("burst", defaultBurst, "Numero di richieste in burst concesse dal rate limiter")
+	minRPS := fs.Float64("min-rps", defaultMinRPS, "Richieste al secondo minime sotto cui il rate limiter non scende mai")
+	metricsAddr := fs.String("metrics-addr", "", "Indirizzo su cui esporre le metriche Prometheus (es. :9090); vuoto per disabilitarle")
+	fs.Parse(args)
+
+	startMetricsServer(*metricsAddr)
+
+	limiter := newAdaptiveLimiter(*rps, *burst, *minRPS)
+	ctx := context.Background()
+
+	chapterListBody, err := makeAPIRequest(ctx, limiter, baseURL+"/chapters")
+	if err != nil {
+		log.Fatalf("Errore critico, impossibile recuperare i capitoli: %v", err)
+	}
+
+	var chapterList ChapterListResponse
+	if err := json.Unmarshal(chapterListBody, &chapterList); err != nil {
+		log.Fatalf("Impossibile fare il parsing della lista capitoli: %v", err)
+	}
+
+	var chapterIDs []string
+	for _, chap := range chapterList.Data {
+		chapterIDs = append(chapterIDs, chap.Attributes.GoodsNomenclatureItemID[:2])
+	}
+
+	srv := newScrapeServer(*cacheDir, *refresh, *maxAge, limiter)
+	go srv.scrapeChapters(ctx, chapterIDs)
+
+	log.Printf("Server in ascolto su %s (capitoli da analizzare: %d)", *addr, len(chapterIDs))
+	if err := http.ListenAndServe(*addr, srv.routes()); err != nil {
+		log.Fatalf("Errore critico del server HTTP: %v", err)
+	}
+}